@@ -0,0 +1,36 @@
+// Package logmw provides a uow.ComponentHook that logs each component's Begin, Commit and
+// Rollback via log/slog.
+package logmw
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ruggi/uow"
+)
+
+// New returns a uow.ComponentHook that logs each component's lifecycle phase to logger, at Error
+// level when the phase failed and Debug level otherwise.
+func New(logger *slog.Logger) uow.ComponentHook {
+	return func(ctx context.Context, phase uow.ComponentPhase, component uow.Transactional, elapsed time.Duration, err error) {
+		attrs := []slog.Attr{
+			slog.String("phase", string(phase)),
+			slog.String("component", componentName(component)),
+			slog.Duration("elapsed", elapsed),
+		}
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "uow: component "+string(phase)+" failed", append(attrs, slog.Any("error", err))...)
+			return
+		}
+		logger.LogAttrs(ctx, slog.LevelDebug, "uow: component "+string(phase), attrs...)
+	}
+}
+
+func componentName(c uow.Transactional) string {
+	if cp, ok := c.(uow.ContextProvider); ok {
+		return fmt.Sprint(cp.ContextKey())
+	}
+	return fmt.Sprintf("%T", c)
+}
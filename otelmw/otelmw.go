@@ -0,0 +1,94 @@
+// Package otelmw provides an OpenTelemetry uow.Middleware and uow.ComponentHook that trace a
+// UnitOfWork's Run calls: a root span per Run, with a child span per component Begin/Commit/
+// Rollback.
+package otelmw
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ruggi/uow"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Otel traces a single UnitOfWork. It is not safe for concurrent Run calls on the same
+// UnitOfWork, consistent with UnitOfWork itself not being safe for concurrent use.
+type Otel struct {
+	tracer trace.Tracer
+
+	mu   sync.Mutex
+	span trace.Span
+}
+
+// New returns an Otel that traces Runs using tracer.
+func New(tracer trace.Tracer) *Otel {
+	return &Otel{tracer: tracer}
+}
+
+// Middleware starts a root span as a child of the incoming ctx (so Run joins the caller's trace,
+// e.g. an HTTP handler's span), injects it into the context every component sees via ContextFunc,
+// and records the call's outcome. Register it with UnitOfWork.Use.
+//
+// It only traces the outer, top-level Run/RunContext call: a nested Run (see
+// UnitOfWork.RunContext) never goes through uow.Middleware, so a nested fn's ContextFunc never
+// carries this span. Work done inside a nested Run is invisible to this package's tracing.
+func (o *Otel) Middleware(next uow.RunFunc) uow.RunFunc {
+	return func(ctx context.Context, fn func(uow.ContextFunc) error) error {
+		ctx, span := o.tracer.Start(ctx, "uow.Run")
+		o.mu.Lock()
+		o.span = span
+		o.mu.Unlock()
+		defer func() {
+			o.mu.Lock()
+			o.span = nil
+			o.mu.Unlock()
+			span.End()
+		}()
+
+		tracedFn := func(cf uow.ContextFunc) error {
+			return fn(func(key interface{}) context.Context {
+				return trace.ContextWithSpan(cf(key), span)
+			})
+		}
+		err := next(ctx, tracedFn)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+}
+
+// ComponentHook records a child span for each component's Begin, Commit or Rollback, and should
+// be registered with UnitOfWork.OnComponent.
+func (o *Otel) ComponentHook(ctx context.Context, phase uow.ComponentPhase, component uow.Transactional, elapsed time.Duration, err error) {
+	o.mu.Lock()
+	parent := o.span
+	o.mu.Unlock()
+	if parent == nil {
+		return
+	}
+
+	_, span := o.tracer.Start(trace.ContextWithSpan(ctx, parent), string(phase))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("uow.component", componentName(component)),
+		attribute.Int64("uow.elapsed_ms", elapsed.Milliseconds()),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func componentName(c uow.Transactional) string {
+	if cp, ok := c.(uow.ContextProvider); ok {
+		return fmt.Sprint(cp.ContextKey())
+	}
+	return fmt.Sprintf("%T", c)
+}
@@ -2,7 +2,13 @@ package uow
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // Transactional begins a transaction.
@@ -10,16 +16,146 @@ type Transactional interface {
 	Begin() (Tx, error)
 }
 
+// ContextTransactional begins a transaction honoring a context and a set of TxOptions. Components
+// that implement this interface are given priority by RunContext; components that don't fall back
+// to the plain Begin().
+type ContextTransactional interface {
+	BeginContext(ctx context.Context, opts ...TxOption) (Tx, error)
+}
+
 // Tx commits or rolls back a set of all-or-nothing operations.
 type Tx interface {
 	Commit() error
 	Rollback() error
 }
 
+// PreparableTx is a Tx that can be prepared ahead of Commit as the first phase of a two-phase
+// commit. gid identifies the distributed transaction and is stable across the prepare, commit and
+// recovery phases.
+type PreparableTx interface {
+	Tx
+	Prepare(gid string) error
+}
+
+// Recoverable lets a component finish a two-phase commit left in doubt by a crash between Prepare
+// and Commit. ContextKey must identify the component stably across process restarts, since it's
+// what ties a RecoveryRecord's participants back to live components in Recover. CommitPrepared
+// must be idempotent: Recover has no record of how far a crashed attempt got, so it always
+// re-issues CommitPrepared against every participant in a record, and a participant that had
+// already committed gid before the crash must treat a repeat call as a successful no-op.
+//
+// There is no RollbackPrepared: commitTwoPhase only writes a RecoveryRecord once every participant
+// has successfully Prepared, so a record Recover finds is always one that decided to commit — a
+// crash during Prepare itself leaves no record, and the already-prepared participants simply time
+// out their own prepared transaction on their side. Recover only ever needs to push a decided
+// commit the rest of the way.
+type Recoverable interface {
+	ContextProvider
+	CommitPrepared(gid string) error
+}
+
+// RecoveryState is the state of a RecoveryRecord.
+type RecoveryState string
+
+// RecoveryStatePrepared marks a two-phase commit whose participants have all prepared
+// successfully, but may not have all committed yet.
+const RecoveryStatePrepared RecoveryState = "prepared"
+
+// RecoveryRecord is a durable record of an in-flight two-phase commit, written before any
+// participant commits and deleted once every participant has committed.
+type RecoveryRecord struct {
+	GID          string
+	Participants []string
+	State        RecoveryState
+}
+
+// RecoveryLog durably records in-flight two-phase commits, so that Recover can finish them after a
+// crash that happens between Prepare and Commit.
+type RecoveryLog interface {
+	Put(record RecoveryRecord) error
+	Delete(gid string) error
+	List() ([]RecoveryRecord, error)
+}
+
+// ErrTwoPhaseCommitIncomplete is wrapped by the error returned from RunContext when a Commit fails
+// after the two-phase commit's RecoveryRecord has already been written. The participants' final state is
+// ambiguous and is intentionally left untouched for Recover to resolve, rather than rolled back.
+var ErrTwoPhaseCommitIncomplete = errors.New("uow: two-phase commit incomplete, see recovery log")
+
+// MultiError aggregates the error that triggered a rollback together with every error returned by
+// the rollback itself, so callers don't lose one in favor of the other. Unwrap exposes every
+// wrapped error, so errors.Is/errors.As matches against any of them.
+type MultiError struct {
+	Errors []error
+}
+
+func (m *MultiError) Error() string {
+	if len(m.Errors) == 1 {
+		return m.Errors[0].Error()
+	}
+	parts := make([]string, len(m.Errors))
+	for i, err := range m.Errors {
+		parts[i] = err.Error()
+	}
+	return fmt.Sprintf("uow: %d errors occurred: %s", len(parts), strings.Join(parts, "; "))
+}
+
+func (m *MultiError) Unwrap() []error {
+	return m.Errors
+}
+
+// SavepointTx is a Tx that supports nested savepoints, letting a Run called recursively from
+// within its own fn compose onto the already-open outer Tx instead of beginning a new one.
+// Components that don't implement SavepointTx simply share the outer Tx for the duration of the
+// nested Run, with no isolation between it and whatever the outer Run (or a sibling nested Run)
+// does to the same Tx.
+type SavepointTx interface {
+	Tx
+	Savepoint(name string) error
+	ReleaseSavepoint(name string) error
+	RollbackToSavepoint(name string) error
+}
+
+// ComponentPhase identifies which lifecycle phase a ComponentHook call reports on.
+type ComponentPhase string
+
+// The phases a ComponentHook is notified about.
+const (
+	PhaseBegin    ComponentPhase = "begin"
+	PhaseCommit   ComponentPhase = "commit"
+	PhaseRollback ComponentPhase = "rollback"
+)
+
+// ComponentHook is notified once a component's Begin, Commit or Rollback completes, with how long
+// it took and its error (nil on success). It's the extension point otelmw and logmw build on for
+// per-component spans and structured log lines without forking this package.
+type ComponentHook func(ctx context.Context, phase ComponentPhase, component Transactional, elapsed time.Duration, err error)
+
+// TxOptions holds the per-transaction settings honored by components implementing
+// ContextTransactional, mirroring database/sql.TxOptions.
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+}
+
+// TxOption configures a TxOptions.
+type TxOption func(*TxOptions)
+
 // UnitOfWork wraps a group of Transactional components and can run multiple transactions as one.
 type UnitOfWork struct {
 	components []Transactional
 	contexts   map[interface{}]interface{}
+
+	onCommit   []func(context.Context) error
+	onRollback []func(context.Context, error)
+
+	recoveryLog RecoveryLog
+
+	depth        int
+	savepointSeq int
+
+	middleware     []Middleware
+	componentHooks []ComponentHook
 }
 
 // NewUnitOfWork creates a new UnitOfWork with the given components. The passed components must implement the Transactional interface.
@@ -38,62 +174,325 @@ func NewUnitOfWork(components ...interface{}) (*UnitOfWork, error) {
 	return unit, nil
 }
 
+// ContextFunc returns a context for a given argument. It replaces the earlier Contextual
+// interface (a single-method `Context(interface{}) context.Context` type): fn now gets a function
+// value directly instead of an object to call a method on, so Middleware (see RunFunc) can swap in
+// a derived ContextFunc without needing a wrapper type. This is a breaking change to Run's
+// signature — every existing `Run(func(uow.Contextual) error)` caller needs updating to
+// `Run(func(uow.ContextFunc) error)` and calling cf(key) instead of c.Context(key) — made
+// deliberately rather than kept compatible, since the two shapes can't be aliased into one fn
+// signature.
+type ContextFunc func(interface{}) context.Context
+
 // Context returns the context for the given argument.
 func (u *UnitOfWork) Context(c interface{}) context.Context {
 	return context.WithValue(context.Background(), c, u.contexts[c])
 }
 
-// Contextual returns a context for a given argument.
-type Contextual interface {
-	Context(interface{}) context.Context
-}
-
 // ContextProvider returns a context key
 type ContextProvider interface {
 	ContextKey() interface{}
 }
 
-// Run runs the given function over the UnitOfWork, transactionally.
-func (u *UnitOfWork) Run(fn func(Contextual) error) (err error) {
-	txs := make([]Tx, 0, len(u.components))
+// OnCommit registers a hook that runs once every component has committed successfully. Hooks run
+// in registration order; the first error returned by a hook aborts the remaining ones and is
+// returned from Run/RunContext, even though the components have already committed by then. Use
+// this, for example, to publish domain events or invalidate caches only on successful commit.
+func (u *UnitOfWork) OnCommit(hook func(ctx context.Context) error) {
+	u.onCommit = append(u.onCommit, hook)
+}
 
-	defer func() {
-		if err == nil {
-			return
+// OnRollback registers a hook that runs with the error that triggered a rollback, once every
+// component has rolled back. Hooks run in registration order.
+func (u *UnitOfWork) OnRollback(hook func(ctx context.Context, err error)) {
+	u.onRollback = append(u.onRollback, hook)
+}
+
+// OnComponent registers a ComponentHook invoked after each component's Begin, Commit or Rollback.
+// Hooks run in registration order.
+func (u *UnitOfWork) OnComponent(hook ComponentHook) {
+	u.componentHooks = append(u.componentHooks, hook)
+}
+
+// fireComponentHook notifies every registered ComponentHook of a component's Begin/Commit/Rollback.
+func (u *UnitOfWork) fireComponentHook(ctx context.Context, phase ComponentPhase, c Transactional, elapsed time.Duration, err error) {
+	for _, hook := range u.componentHooks {
+		hook(ctx, phase, c, elapsed, err)
+	}
+}
+
+// RunFunc runs fn transactionally against ctx and returns its error; it's what Middleware wraps.
+// ctx is the one passed to RunContext (or context.Background() for Run), possibly replaced by an
+// outer Middleware with a derived context, e.g. one carrying a tracing span.
+type RunFunc func(ctx context.Context, fn func(ContextFunc) error) error
+
+// Middleware wraps a RunFunc, letting cross-cutting concerns (tracing, logging, metrics, auth)
+// compose around Run/RunContext without forking this package. A Middleware that needs to inject
+// values into the context components see (BeginContext, ComponentHooks) should call next with a
+// derived ctx. The ContextFunc passed to fn is not derived from ctx, so to reach fn a Middleware
+// wraps fn and hands it a ContextFunc of its own. Middleware
+// only wraps top-level Run/RunContext calls, not a nested one (see RunContext), so a fn called via
+// a nested Run never sees whatever a Middleware injected into the outer call's ContextFunc.
+type Middleware func(next RunFunc) RunFunc
+
+// Use appends middleware to the chain applied around every subsequent top-level Run/RunContext
+// call. Middleware registered first wraps outermost, mirroring the usual net/http convention.
+func (u *UnitOfWork) Use(mw ...Middleware) {
+	u.middleware = append(u.middleware, mw...)
+}
+
+// SetRecoveryLog configures the durable log used for two-phase commits. Once set, Run/RunContext
+// switch to the prepare/commit protocol for every component whose Tx implements PreparableTx, and
+// Recover becomes able to replay the log after a crash.
+func (u *UnitOfWork) SetRecoveryLog(log RecoveryLog) {
+	u.recoveryLog = log
+}
+
+// Recover scans the RecoveryLog for two-phase commits left in doubt by a crash between Prepare and
+// Commit, and finishes them by re-issuing Commit on every participant that implements Recoverable.
+// It's meant to run once at startup, before any Run/RunContext call touches the same components.
+// A record that can't be recovered (e.g. an unknown or renamed participant) doesn't block the
+// others: Recover keeps going and returns every failure it hit, aggregated into a MultiError.
+func (u *UnitOfWork) Recover(ctx context.Context) error {
+	if u.recoveryLog == nil {
+		return nil
+	}
+
+	records, err := u.recoveryLog.List()
+	if err != nil {
+		return err
+	}
+
+	recoverable := make(map[string]Recoverable, len(u.components))
+	for _, c := range u.components {
+		if r, ok := c.(Recoverable); ok {
+			recoverable[fmt.Sprint(r.ContextKey())] = r
 		}
-		for _, tx := range txs {
-			rbErr := tx.Rollback()
-			if rbErr != nil {
-				// ... do something about it
-			}
+	}
+
+	var errs []error
+	for _, record := range records {
+		if err := u.recoverRecord(record, recoverable); err != nil {
+			errs = append(errs, err)
+			continue
 		}
-	}()
+		if err := u.recoveryLog.Delete(record.GID); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
-	defer func() {
-		if err != nil {
-			return
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return &MultiError{Errors: errs}
+	}
+}
+
+// recoverRecord finishes a single RecoveryRecord by re-issuing CommitPrepared against every
+// participant recorded for it.
+func (u *UnitOfWork) recoverRecord(record RecoveryRecord, recoverable map[string]Recoverable) error {
+	for _, id := range record.Participants {
+		r, ok := recoverable[id]
+		if !ok {
+			return fmt.Errorf("uow: recover gid %q: unknown participant %q", record.GID, id)
 		}
-		for _, tx := range txs {
-			err = tx.Commit()
-			if err != nil { // good job, you broke it!
-				return
+		if err := r.CommitPrepared(record.GID); err != nil {
+			return fmt.Errorf("uow: recover gid %q: %w", record.GID, err)
+		}
+	}
+	return nil
+}
+
+// runConfig holds the options collected from a single Run/RunContext call.
+type runConfig struct {
+	TxOptions
+	ignoredErrors        []error
+	retryAttempts        int
+	isRetryable          func(error) bool
+	rollbackErrorHandler func(Transactional, error)
+}
+
+// isIgnored reports whether err matches one of the errors registered with WithIgnoredErrors.
+func (c runConfig) isIgnored(err error) bool {
+	for _, ignored := range c.ignoredErrors {
+		if errors.Is(err, ignored) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunOption configures a single Run/RunContext call.
+type RunOption func(*runConfig)
+
+// WithIsolation sets the isolation level of the transactions begun by Run/RunContext.
+func WithIsolation(level sql.IsolationLevel) RunOption {
+	return func(c *runConfig) {
+		c.Isolation = level
+	}
+}
+
+// WithReadOnly marks the transactions begun by Run/RunContext as read-only.
+func WithReadOnly(readOnly bool) RunOption {
+	return func(c *runConfig) {
+		c.ReadOnly = readOnly
+	}
+}
+
+// WithIgnoredErrors marks errors that, when returned by fn, still let the transactions commit.
+// The error is still returned from Run/RunContext once every component has committed, so callers
+// can tell the operation's outcome apart from a hard failure by comparing it with errors.Is.
+func WithIgnoredErrors(errs ...error) RunOption {
+	return func(c *runConfig) {
+		c.ignoredErrors = append(c.ignoredErrors, errs...)
+	}
+}
+
+// WithRetryOnSerializationFailure makes a nested Run (one called recursively from within an outer
+// Run's fn) run fn up to attempts times in all, the first call included: whenever fn returns an
+// error for which isRetryable reports true, every participating SavepointTx is rolled back to the
+// entry savepoint and fn is re-invoked. It has no effect on a top-level Run, since there is no entry savepoint to roll back
+// to; useful for retrying Postgres serializable-isolation (SSI) conflicts.
+func WithRetryOnSerializationFailure(attempts int, isRetryable func(error) bool) RunOption {
+	return func(c *runConfig) {
+		c.retryAttempts = attempts
+		c.isRetryable = isRetryable
+	}
+}
+
+// WithRollbackErrorHandler registers a handler invoked for every error returned by a component's
+// Rollback during Run/RunContext, for logging: rollback errors are also folded into the returned
+// error (see MultiError), but by the time a caller sees it the per-component detail needed for an
+// alert (which component, which Tx) is gone.
+func WithRollbackErrorHandler(handler func(Transactional, error)) RunOption {
+	return func(c *runConfig) {
+		c.rollbackErrorHandler = handler
+	}
+}
+
+// Run runs the given function over the UnitOfWork, transactionally.
+func (u *UnitOfWork) Run(fn func(ContextFunc) error, opts ...RunOption) (err error) {
+	return u.RunContext(context.Background(), fn, opts...)
+}
+
+// txParticipant pairs a component with the Tx it began in a single Run/RunContext call.
+type txParticipant struct {
+	component Transactional
+	tx        Tx
+}
+
+// RunContext runs the given function over the UnitOfWork, transactionally, threading ctx through
+// every component's Begin/BeginContext. opts configure the transactions begun (e.g. WithIsolation,
+// WithReadOnly) and the Run call itself (e.g. WithIgnoredErrors), so the same UnitOfWork can
+// execute mixed read-only and serializable transactions depending on the call. If ctx is cancelled
+// or its deadline expires before commit starts, including while fn runs, every transaction begun
+// so far is rolled back and ctx's error is returned. fn itself is not interrupted: the ContextFunc
+// it gets is not derived from ctx.
+//
+// If a RecoveryLog is configured (see SetRecoveryLog) and at least one participant's Tx implements
+// PreparableTx, commit goes through a two-phase protocol instead of a plain Commit loop: every
+// PreparableTx is prepared, a RecoveryRecord is written, and only then are all participants
+// committed. A failure past that point leaves the record in place for Recover to finish, rather
+// than attempting a blind Rollback of transactions that may already be committed.
+//
+// Calling Run/RunContext again from within fn nests: the outer call still owns Begin/Commit/
+// Rollback, and the nested call only pushes/pops a savepoint (see SavepointTx) on the Txs already
+// open in u.contexts, so a component can compose transactional operations without knowing whether
+// it's the top-level caller.
+//
+// Middleware registered with Use wraps the whole call (see RunFunc); ComponentHooks registered
+// with OnComponent are notified around every component's Begin/Commit/Rollback. This is a
+// top-level-only concern: a nested Run/RunContext call (see above) never runs u.middleware, so a
+// Middleware that injects values into the ContextFunc fn sees (e.g. otelmw's span injection) only
+// reaches the outer fn, not a nested one. This is a real limitation, not a cosmetic one — the
+// contexts a nested fn gets carry no span from a Middleware-based tracer, so its work joins
+// neither the outer span nor a child of it — and composing Middleware with nesting needs to
+// account for it.
+func (u *UnitOfWork) RunContext(ctx context.Context, fn func(ContextFunc) error, opts ...RunOption) error {
+	cfg := runConfig{}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	if u.depth > 0 {
+		// Deliberately bypasses u.middleware: see the doc comment above.
+		return u.runNested(fn, cfg)
+	}
+	u.depth++
+	defer func() { u.depth-- }()
+
+	runner := RunFunc(func(ctx context.Context, fn func(ContextFunc) error) error {
+		return u.runOnce(ctx, fn, cfg)
+	})
+	for i := len(u.middleware) - 1; i >= 0; i-- {
+		runner = u.middleware[i](runner)
+	}
+	return runner(ctx, fn)
+}
+
+// runOnce is the top-level Begin/fn/Commit-or-Rollback cycle that RunContext wraps with
+// middleware.
+func (u *UnitOfWork) runOnce(ctx context.Context, fn func(ContextFunc) error, cfg runConfig) (err error) {
+	// u.contexts only needs to live for the duration of this call: nested runNested calls read it
+	// while fn is running, but a fresh top-level call must start from an empty map, or it finds its
+	// predecessor's keys still in place and silently skips Begin for every component (see
+	// contextTx/runNested).
+	u.contexts = map[interface{}]interface{}{}
+	defer func() { u.contexts = map[interface{}]interface{}{} }()
+
+	participants := make([]txParticipant, 0, len(u.components))
+	var ignoredErr error
+
+	// rollback rolls toRollback back in reverse of their begin order and returns triggerErr,
+	// aggregated with any rollback errors into a MultiError so callers can't lose one in favor of
+	// the other. Callers must only pass participants whose Commit hasn't already succeeded: Tx's
+	// contract, like database/sql's, doesn't allow a second terminal call once Commit has returned
+	// nil.
+	rollback := func(triggerErr error, toRollback []txParticipant) error {
+		errs := []error{triggerErr}
+		for i := len(toRollback) - 1; i >= 0; i-- {
+			p := toRollback[i]
+			start := time.Now()
+			rbErr := p.tx.Rollback()
+			u.fireComponentHook(ctx, PhaseRollback, p.component, time.Since(start), rbErr)
+			if rbErr != nil {
+				errs = append(errs, rbErr)
+				if cfg.rollbackErrorHandler != nil {
+					cfg.rollbackErrorHandler(p.component, rbErr)
+				}
 			}
 		}
-	}()
+		for _, hook := range u.onRollback {
+			hook(ctx, triggerErr)
+		}
+		if len(errs) == 1 {
+			return triggerErr
+		}
+		return &MultiError{Errors: errs}
+	}
 
 	defer func() {
 		rec := recover()
-		if rec != nil {
-			switch t := rec.(type) {
-			case error:
-				err = t
-			default:
-				err = fmt.Errorf("recovered: %v", t)
-			}
+		if rec == nil {
+			return
+		}
+		switch t := rec.(type) {
+		case error:
+			err = t
+		default:
+			err = fmt.Errorf("recovered: %v", t)
 		}
+		err = rollback(err, participants)
 	}()
 
 	for _, c := range u.components {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return rollback(ctxErr, participants)
+		}
+
 		var key interface{} = c
 		if cp, ok := c.(ContextProvider); ok {
 			key = cp.ContextKey()
@@ -101,15 +500,228 @@ func (u *UnitOfWork) Run(fn func(Contextual) error) (err error) {
 		if _, ok := u.contexts[key]; ok { // make sure that the same context providers share the same context
 			continue
 		}
-		tx, err := c.Begin()
+
+		start := time.Now()
+		tx, beginErr := beginTx(ctx, c, cfg.TxOptions)
+		u.fireComponentHook(ctx, PhaseBegin, c, time.Since(start), beginErr)
+		if beginErr != nil {
+			return rollback(beginErr, participants)
+		}
+		u.contexts[key] = tx
+		participants = append(participants, txParticipant{component: c, tx: tx})
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return rollback(ctxErr, participants)
+	}
+
+	if fnErr := fn(u.Context); fnErr != nil {
+		if !cfg.isIgnored(fnErr) {
+			return rollback(fnErr, participants)
+		}
+		ignoredErr = fnErr
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return rollback(ctxErr, participants)
+	}
+
+	if u.usesTwoPhaseCommit(participants) {
+		if err = u.commitTwoPhase(ctx, participants); err != nil {
+			if !errors.Is(err, ErrTwoPhaseCommitIncomplete) {
+				err = rollback(err, participants)
+			}
+			return err
+		}
+	} else {
+		for i, p := range participants {
+			start := time.Now()
+			commitErr := p.tx.Commit()
+			u.fireComponentHook(ctx, PhaseCommit, p.component, time.Since(start), commitErr)
+			if commitErr != nil { // good job, you broke it!
+				// Only the participants from i onward haven't committed; everything before i
+				// already has, and calling Rollback on it would be a second terminal call on an
+				// already-finished Tx.
+				return rollback(commitErr, participants[i:])
+			}
+		}
+	}
+
+	// Every participant has committed by now: a failing OnCommit hook can't be rolled back, just
+	// reported.
+	for _, hook := range u.onCommit {
+		if err = hook(ctx); err != nil {
+			return err
+		}
+	}
+
+	return ignoredErr
+}
+
+// usesTwoPhaseCommit reports whether participants should commit through the prepare/commit
+// protocol instead of a plain Commit loop.
+func (u *UnitOfWork) usesTwoPhaseCommit(participants []txParticipant) bool {
+	if u.recoveryLog == nil {
+		return false
+	}
+	for _, p := range participants {
+		if _, ok := p.tx.(PreparableTx); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// commitTwoPhase prepares every PreparableTx among participants, durably records the resulting
+// RecoveryRecord, and only then commits every participant (preparable or not). An error returned
+// before the record is written means nothing has committed and the caller can safely roll back;
+// an error returned after (one wrapping ErrTwoPhaseCommitIncomplete) means some participants may
+// already be committed and the record is left for Recover.
+func (u *UnitOfWork) commitTwoPhase(ctx context.Context, participants []txParticipant) error {
+	gid, err := newGID()
+	if err != nil {
+		return err
+	}
+
+	prepared := make([]string, 0, len(participants))
+	for _, p := range participants {
+		pt, ok := p.tx.(PreparableTx)
+		if !ok {
+			continue
+		}
+		if err := pt.Prepare(gid); err != nil {
+			return err
+		}
+		prepared = append(prepared, participantID(p.component))
+	}
+
+	if err := u.recoveryLog.Put(RecoveryRecord{GID: gid, Participants: prepared, State: RecoveryStatePrepared}); err != nil {
+		return err
+	}
+
+	for _, p := range participants {
+		start := time.Now()
+		err := p.tx.Commit()
+		u.fireComponentHook(ctx, PhaseCommit, p.component, time.Since(start), err)
 		if err != nil {
+			return fmt.Errorf("%w: %v", ErrTwoPhaseCommitIncomplete, err)
+		}
+	}
+
+	return u.recoveryLog.Delete(gid)
+}
+
+// runNested runs fn within a nested Run/RunContext call: it pushes a savepoint onto every
+// already-open Tx that implements SavepointTx, runs fn, and releases the savepoint on success or
+// rolls back to it on error. An error matching cfg.isIgnored (see WithIgnoredErrors) is treated
+// like success: the savepoint is released, not rolled back, and the error is still returned so
+// errors.Is sees it, mirroring runOnce. Components sharing a Tx (see ContextProvider) are only
+// savepointed once. The outer Run still owns Begin/Commit/Rollback for the Tx itself.
+func (u *UnitOfWork) runNested(fn func(ContextFunc) error, cfg runConfig) error {
+	name := u.nextSavepointName()
+
+	seen := map[Tx]bool{}
+	savepoints := make([]SavepointTx, 0, len(u.components))
+	for _, c := range u.components {
+		tx, ok := u.contextTx(c)
+		if !ok || seen[tx] {
+			continue
+		}
+		seen[tx] = true
+		if sp, ok := tx.(SavepointTx); ok {
+			savepoints = append(savepoints, sp)
+		}
+	}
+
+	attempts := cfg.retryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		for _, sp := range savepoints {
+			if spErr := sp.Savepoint(name); spErr != nil {
+				return spErr
+			}
+		}
+
+		fnErr := fn(u.Context)
+		if fnErr == nil || cfg.isIgnored(fnErr) {
+			// An ignored fnErr still releases the savepoint like success does: WithIgnoredErrors
+			// means the caller wants the work kept, just told apart from a hard failure via
+			// errors.Is, the same contract runOnce honors for a top-level Run.
+			for _, sp := range savepoints {
+				if relErr := sp.ReleaseSavepoint(name); relErr != nil {
+					return relErr
+				}
+			}
+			return fnErr
+		}
+
+		// Retryability is judged against fnErr alone: a failed RollbackToSavepoint doesn't change
+		// whether fn's own error is worth retrying, but it must still surface to the caller instead
+		// of being dropped, so it's folded into the returned error below.
+		errs := []error{fnErr}
+		for _, sp := range savepoints {
+			if rbErr := sp.RollbackToSavepoint(name); rbErr != nil {
+				errs = append(errs, rbErr)
+			}
+		}
+		if len(errs) == 1 {
+			err = fnErr
+		} else {
+			err = &MultiError{Errors: errs}
+		}
+
+		if cfg.isRetryable == nil || attempt == attempts-1 || !cfg.isRetryable(fnErr) {
 			return err
 		}
-		u.contexts[key] = tx
-		txs = append(txs, tx)
 	}
+	return err
+}
 
-	return fn(u)
+// contextTx returns the Tx already begun for c in this UnitOfWork's run, if any.
+func (u *UnitOfWork) contextTx(c Transactional) (Tx, bool) {
+	var key interface{} = c
+	if cp, ok := c.(ContextProvider); ok {
+		key = cp.ContextKey()
+	}
+	tx, ok := u.contexts[key].(Tx)
+	return tx, ok
+}
+
+// nextSavepointName returns a name unique within this UnitOfWork for a new nested savepoint.
+func (u *UnitOfWork) nextSavepointName() string {
+	u.savepointSeq++
+	return fmt.Sprintf("uow_sp_%d", u.savepointSeq)
+}
+
+// participantID returns the stable identifier a component is recovered by, preferring
+// ContextProvider.ContextKey() and falling back to the component's type.
+func participantID(c Transactional) string {
+	if cp, ok := c.(ContextProvider); ok {
+		return fmt.Sprint(cp.ContextKey())
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+// newGID returns a random identifier for a distributed transaction.
+func newGID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("uow: generating transaction id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// beginTx begins a transaction for c, preferring BeginContext when c implements
+// ContextTransactional and falling back to the context-less Begin() otherwise.
+func beginTx(ctx context.Context, c Transactional, txOpts TxOptions) (Tx, error) {
+	if ct, ok := c.(ContextTransactional); ok {
+		return ct.BeginContext(ctx, func(o *TxOptions) { *o = txOpts })
+	}
+	return c.Begin()
 }
 
 // NopTx is a no-op transaction that can be used to implement temporary/dummy Transactional types.
@@ -2,8 +2,11 @@ package uow_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/ruggi/uow"
 	"github.com/stretchr/testify/assert"
@@ -65,6 +68,22 @@ func TestNewUOW(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestUOWRun_CalledTwiceBeginsFreshTransactionsEachTime(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	err = unit.Run(func(uow.ContextFunc) error { return nil })
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+
+	a.tx = tx{value: "tx a 2"}
+	err = unit.Run(func(uow.ContextFunc) error { return nil })
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+}
+
 func TestUOWRun(t *testing.T) {
 	tests := []struct {
 		a             *foo
@@ -160,7 +179,7 @@ func TestUOWRun(t *testing.T) {
 			shouldError:   true,
 			expectedError: fmt.Errorf("b commit err"),
 			txaCommitted:  true,
-			txaRolledBack: true,
+			txaRolledBack: false,
 			txbCommitted:  true,
 			txbRolledBack: true,
 			expectedValue: "tx b",
@@ -221,3 +240,714 @@ func TestUOWRun(t *testing.T) {
 		assert.Equal(t, tt.expectedValue, result)
 	}
 }
+
+type ctxFoo struct {
+	tx          tx
+	beginErr    error
+	calledBegin bool
+	calledCtx   bool
+	gotOpts     []uow.TxOption
+}
+
+func (f *ctxFoo) Begin() (uow.Tx, error) {
+	f.calledBegin = true
+	return &f.tx, f.beginErr
+}
+
+func (f *ctxFoo) BeginContext(ctx context.Context, opts ...uow.TxOption) (uow.Tx, error) {
+	f.calledCtx = true
+	f.gotOpts = opts
+	return &f.tx, f.beginErr
+}
+
+func TestUOWRunContext_PrefersBeginContext(t *testing.T) {
+	a := &ctxFoo{tx: tx{value: "tx a"}}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	err = unit.RunContext(context.Background(), func(uow.ContextFunc) error {
+		return nil
+	}, uow.WithReadOnly(true))
+	require.NoError(t, err)
+
+	assert.True(t, a.calledCtx)
+	assert.False(t, a.calledBegin)
+	assert.True(t, a.tx.committed)
+
+	var opts uow.TxOptions
+	for _, o := range a.gotOpts {
+		o(&opts)
+	}
+	assert.True(t, opts.ReadOnly)
+}
+
+func TestUOWRunContext_FallsBackToBegin(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	err = unit.RunContext(context.Background(), func(uow.ContextFunc) error {
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+}
+
+type cancelingFoo struct {
+	foo
+	cancel context.CancelFunc
+}
+
+func (f *cancelingFoo) Begin() (uow.Tx, error) {
+	tx, err := f.foo.Begin()
+	f.cancel()
+	return tx, err
+}
+
+func TestUOWRunContext_CancelledContextRollsBack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &cancelingFoo{foo: foo{value: "a", tx: tx{value: "tx a"}}}
+	a.cancel = cancel
+	b := &foo{value: "b", tx: tx{value: "tx b"}}
+
+	unit, err := uow.NewUnitOfWork(a, b)
+	require.NoError(t, err)
+
+	err = unit.RunContext(ctx, func(uow.ContextFunc) error {
+		t.Fatal("fn should not be called once the context is cancelled")
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, a.tx.rolledBack)
+	assert.False(t, b.tx.committed)
+	assert.False(t, b.tx.rolledBack)
+}
+
+func TestUOWOnCommit(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	var called bool
+	unit.OnCommit(func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+	assert.True(t, called)
+}
+
+func TestUOWOnCommit_HookError(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	hookErr := fmt.Errorf("hook err")
+	unit.OnCommit(func(ctx context.Context) error {
+		return hookErr
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, hookErr.Error(), err.Error())
+	assert.True(t, a.tx.committed)
+	assert.False(t, a.tx.rolledBack)
+}
+
+func TestUOWOnRollback(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}, err: fmt.Errorf("boom a")}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	var gotErr error
+	unit.OnRollback(func(ctx context.Context, err error) {
+		gotErr = err
+	})
+
+	err = unit.Run(func(ctx uow.ContextFunc) error {
+		_, err := a.Foo(ctx(a))
+		return err
+	})
+	require.Error(t, err)
+	assert.True(t, a.tx.rolledBack)
+	require.Error(t, gotErr)
+	assert.Equal(t, "boom a", gotErr.Error())
+}
+
+func TestUOWWithIgnoredErrors(t *testing.T) {
+	notFound := fmt.Errorf("not found")
+	a := &foo{value: "a", tx: tx{value: "tx a"}, err: fmt.Errorf("wrap: %w", notFound)}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	err = unit.Run(func(ctx uow.ContextFunc) error {
+		_, err := a.Foo(ctx(a))
+		return err
+	}, uow.WithIgnoredErrors(notFound))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, notFound))
+	assert.True(t, a.tx.committed)
+	assert.False(t, a.tx.rolledBack)
+}
+
+type preparableTx struct {
+	tx
+	prepareErr error
+	prepared   bool
+	gid        string
+}
+
+func (t *preparableTx) Prepare(gid string) error {
+	t.prepared = true
+	t.gid = gid
+	return t.prepareErr
+}
+
+type preparableFoo struct {
+	key string
+	tx  preparableTx
+}
+
+func (f *preparableFoo) Begin() (uow.Tx, error) {
+	return &f.tx, nil
+}
+
+func (f *preparableFoo) ContextKey() interface{} {
+	return f.key
+}
+
+func (f *preparableFoo) CommitPrepared(gid string) error {
+	f.tx.committed = true
+	return nil
+}
+
+type memRecoveryLog struct {
+	records map[string]uow.RecoveryRecord
+}
+
+func newMemRecoveryLog() *memRecoveryLog {
+	return &memRecoveryLog{records: map[string]uow.RecoveryRecord{}}
+}
+
+func (l *memRecoveryLog) Put(r uow.RecoveryRecord) error {
+	l.records[r.GID] = r
+	return nil
+}
+
+func (l *memRecoveryLog) Delete(gid string) error {
+	delete(l.records, gid)
+	return nil
+}
+
+func (l *memRecoveryLog) List() ([]uow.RecoveryRecord, error) {
+	out := make([]uow.RecoveryRecord, 0, len(l.records))
+	for _, r := range l.records {
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func TestUOWTwoPhaseCommit_Success(t *testing.T) {
+	a := &preparableFoo{key: "a"}
+	log := newMemRecoveryLog()
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+	unit.SetRecoveryLog(log)
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, a.tx.prepared)
+	assert.True(t, a.tx.committed)
+	assert.Empty(t, log.records)
+}
+
+func TestUOWTwoPhaseCommit_PrepareFailureRollsBack(t *testing.T) {
+	a := &preparableFoo{key: "a"}
+	a.tx.prepareErr = fmt.Errorf("prepare err")
+	log := newMemRecoveryLog()
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+	unit.SetRecoveryLog(log)
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, "prepare err", err.Error())
+	assert.True(t, a.tx.rolledBack)
+	assert.False(t, a.tx.committed)
+	assert.Empty(t, log.records)
+}
+
+func TestUOWTwoPhaseCommit_CommitFailureLeavesRecoveryRecord(t *testing.T) {
+	a := &preparableFoo{key: "a"}
+	a.tx.commitErr = fmt.Errorf("commit err")
+	log := newMemRecoveryLog()
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+	unit.SetRecoveryLog(log)
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return nil
+	})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, uow.ErrTwoPhaseCommitIncomplete))
+	assert.False(t, a.tx.rolledBack)
+	assert.Len(t, log.records, 1)
+}
+
+func TestUOWRecover(t *testing.T) {
+	a := &preparableFoo{key: "a"}
+	log := newMemRecoveryLog()
+	log.records["gid-1"] = uow.RecoveryRecord{
+		GID:          "gid-1",
+		Participants: []string{"a"},
+		State:        uow.RecoveryStatePrepared,
+	}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+	unit.SetRecoveryLog(log)
+
+	err = unit.Recover(context.Background())
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+	assert.Empty(t, log.records)
+}
+
+func TestUOWRecover_UnknownParticipantDoesNotBlockOtherRecords(t *testing.T) {
+	a := &preparableFoo{key: "a"}
+	log := newMemRecoveryLog()
+	log.records["gid-bad"] = uow.RecoveryRecord{
+		GID:          "gid-bad",
+		Participants: []string{"missing"},
+		State:        uow.RecoveryStatePrepared,
+	}
+	log.records["gid-good"] = uow.RecoveryRecord{
+		GID:          "gid-good",
+		Participants: []string{"a"},
+		State:        uow.RecoveryStatePrepared,
+	}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+	unit.SetRecoveryLog(log)
+
+	err = unit.Recover(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gid-bad")
+	assert.Contains(t, err.Error(), "missing")
+
+	assert.True(t, a.tx.committed)
+	_, stillRecorded := log.records["gid-good"]
+	assert.False(t, stillRecorded)
+	_, stillRecordedBad := log.records["gid-bad"]
+	assert.True(t, stillRecordedBad)
+}
+
+type savepointTx struct {
+	tx
+	savepoints    []string
+	released      []string
+	rolledBackTo  []string
+	savepointErr  error
+	releaseErr    error
+	rollbackSpErr error
+}
+
+func (t *savepointTx) Savepoint(name string) error {
+	t.savepoints = append(t.savepoints, name)
+	return t.savepointErr
+}
+
+func (t *savepointTx) ReleaseSavepoint(name string) error {
+	t.released = append(t.released, name)
+	return t.releaseErr
+}
+
+func (t *savepointTx) RollbackToSavepoint(name string) error {
+	t.rolledBackTo = append(t.rolledBackTo, name)
+	return t.rollbackSpErr
+}
+
+type savepointFoo struct {
+	value string
+	tx    savepointTx
+}
+
+func (f *savepointFoo) Begin() (uow.Tx, error) {
+	return &f.tx, nil
+}
+
+func TestUOWNestedRun_SavepointAndRelease(t *testing.T) {
+	a := &savepointFoo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return unit.Run(func(uow.ContextFunc) error {
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+	assert.Len(t, a.tx.savepoints, 1)
+	assert.Equal(t, a.tx.savepoints, a.tx.released)
+	assert.Empty(t, a.tx.rolledBackTo)
+}
+
+func TestUOWNestedRun_RollbackToSavepointOnError(t *testing.T) {
+	a := &savepointFoo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	boom := fmt.Errorf("boom")
+	err = unit.Run(func(uow.ContextFunc) error {
+		innerErr := unit.Run(func(uow.ContextFunc) error {
+			return boom
+		})
+		require.Error(t, innerErr)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+	assert.Len(t, a.tx.savepoints, 1)
+	assert.Empty(t, a.tx.released)
+	assert.Equal(t, a.tx.savepoints, a.tx.rolledBackTo)
+}
+
+func TestUOWNestedRun_RollbackToSavepointErrorIsAggregated(t *testing.T) {
+	a := &savepointFoo{value: "a"}
+	rollbackSpErr := fmt.Errorf("connection reset")
+	a.tx.rollbackSpErr = rollbackSpErr
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	fnErr := fmt.Errorf("boom")
+	var innerErr error
+	err = unit.Run(func(uow.ContextFunc) error {
+		innerErr = unit.Run(func(uow.ContextFunc) error {
+			return fnErr
+		})
+		return nil
+	})
+	require.NoError(t, err)
+	require.Error(t, innerErr)
+	assert.True(t, errors.Is(innerErr, fnErr))
+	assert.True(t, errors.Is(innerErr, rollbackSpErr))
+
+	var multi *uow.MultiError
+	require.ErrorAs(t, innerErr, &multi)
+	assert.Len(t, multi.Errors, 2)
+}
+
+func TestUOWNestedRun_WithIgnoredErrorsReleasesSavepointInsteadOfRollingBack(t *testing.T) {
+	a := &savepointFoo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		innerErr := unit.Run(func(uow.ContextFunc) error {
+			return sql.ErrNoRows
+		}, uow.WithIgnoredErrors(sql.ErrNoRows))
+		assert.True(t, errors.Is(innerErr, sql.ErrNoRows))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, a.tx.committed)
+	assert.Len(t, a.tx.savepoints, 1)
+	assert.Equal(t, a.tx.savepoints, a.tx.released)
+	assert.Empty(t, a.tx.rolledBackTo)
+}
+
+func TestUOWNestedRun_FallsBackWithoutSavepointTx(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	var called bool
+	err = unit.Run(func(uow.ContextFunc) error {
+		return unit.Run(func(uow.ContextFunc) error {
+			called = true
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	assert.True(t, called)
+	assert.True(t, a.tx.committed)
+}
+
+func TestUOWNestedRun_RetryOnSerializationFailure(t *testing.T) {
+	a := &savepointFoo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	serializationErr := fmt.Errorf("could not serialize access")
+	var attempts int
+	err = unit.Run(func(uow.ContextFunc) error {
+		return unit.Run(func(uow.ContextFunc) error {
+			attempts++
+			if attempts < 3 {
+				return serializationErr
+			}
+			return nil
+		}, uow.WithRetryOnSerializationFailure(5, func(err error) bool {
+			return errors.Is(err, serializationErr)
+		}))
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, a.tx.savepoints, 3)
+	assert.Len(t, a.tx.rolledBackTo, 2)
+	assert.Len(t, a.tx.released, 1)
+	assert.True(t, a.tx.committed)
+}
+
+func TestUOWUse_WrapsRun(t *testing.T) {
+	a := &foo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	var trace []string
+	unit.Use(func(next uow.RunFunc) uow.RunFunc {
+		return func(ctx context.Context, fn func(uow.ContextFunc) error) error {
+			trace = append(trace, "before")
+			err := next(ctx, fn)
+			trace = append(trace, "after")
+			return err
+		}
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		trace = append(trace, "fn")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"before", "fn", "after"}, trace)
+}
+
+func TestUOWUse_ChainsInRegistrationOrder(t *testing.T) {
+	a := &foo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	var trace []string
+	mw := func(name string) uow.Middleware {
+		return func(next uow.RunFunc) uow.RunFunc {
+			return func(ctx context.Context, fn func(uow.ContextFunc) error) error {
+				trace = append(trace, name+":before")
+				err := next(ctx, fn)
+				trace = append(trace, name+":after")
+				return err
+			}
+		}
+	}
+	unit.Use(mw("outer"), mw("inner"))
+
+	err = unit.Run(func(uow.ContextFunc) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"outer:before", "inner:before", "inner:after", "outer:after"}, trace)
+}
+
+func TestUOWUse_CanInjectContext(t *testing.T) {
+	type key struct{}
+	a := &foo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	unit.Use(func(next uow.RunFunc) uow.RunFunc {
+		return func(ctx context.Context, fn func(uow.ContextFunc) error) error {
+			return next(ctx, func(cf uow.ContextFunc) error {
+				return fn(func(k interface{}) context.Context {
+					return context.WithValue(cf(k), key{}, "injected")
+				})
+			})
+		}
+	})
+
+	var got string
+	err = unit.Run(func(cf uow.ContextFunc) error {
+		got, _ = cf(a).Value(key{}).(string)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "injected", got)
+}
+
+func TestUOWUse_CanReplaceContextSeenByComponentHooks(t *testing.T) {
+	type key struct{}
+	a := &foo{value: "a"}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	unit.Use(func(next uow.RunFunc) uow.RunFunc {
+		return func(ctx context.Context, fn func(uow.ContextFunc) error) error {
+			return next(context.WithValue(ctx, key{}, "from middleware"), fn)
+		}
+	})
+
+	var got string
+	unit.OnComponent(func(ctx context.Context, phase uow.ComponentPhase, _ uow.Transactional, _ time.Duration, _ error) {
+		if phase == uow.PhaseBegin {
+			got, _ = ctx.Value(key{}).(string)
+		}
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, "from middleware", got)
+}
+
+func TestUOWOnComponent(t *testing.T) {
+	a := &foo{value: "a"}
+	b := &foo{value: "b"}
+
+	unit, err := uow.NewUnitOfWork(a, b)
+	require.NoError(t, err)
+
+	type event struct {
+		phase     uow.ComponentPhase
+		component uow.Transactional
+		err       error
+	}
+	var events []event
+	unit.OnComponent(func(_ context.Context, phase uow.ComponentPhase, component uow.Transactional, elapsed time.Duration, err error) {
+		assert.GreaterOrEqual(t, elapsed, time.Duration(0))
+		events = append(events, event{phase: phase, component: component, err: err})
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error { return nil })
+	require.NoError(t, err)
+
+	require.Len(t, events, 4)
+	assert.Equal(t, uow.PhaseBegin, events[0].phase)
+	assert.Equal(t, a, events[0].component)
+	assert.Equal(t, uow.PhaseBegin, events[1].phase)
+	assert.Equal(t, b, events[1].component)
+	assert.Equal(t, uow.PhaseCommit, events[2].phase)
+	assert.Equal(t, uow.PhaseCommit, events[3].phase)
+}
+
+func TestUOWOnComponent_FiresOnRollback(t *testing.T) {
+	a := &foo{value: "a", err: fmt.Errorf("boom")}
+
+	unit, err := uow.NewUnitOfWork(a)
+	require.NoError(t, err)
+
+	var phases []uow.ComponentPhase
+	unit.OnComponent(func(_ context.Context, phase uow.ComponentPhase, _ uow.Transactional, _ time.Duration, _ error) {
+		phases = append(phases, phase)
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return a.err
+	})
+	require.Error(t, err)
+	assert.Equal(t, []uow.ComponentPhase{uow.PhaseBegin, uow.PhaseRollback}, phases)
+}
+
+func TestUOWRollback_ReverseOrderOfBegin(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+	b := &foo{value: "b", tx: tx{value: "tx b"}, err: fmt.Errorf("boom")}
+
+	unit, err := uow.NewUnitOfWork(a, b)
+	require.NoError(t, err)
+
+	var order []uow.Transactional
+	unit.OnComponent(func(_ context.Context, phase uow.ComponentPhase, component uow.Transactional, _ time.Duration, _ error) {
+		if phase == uow.PhaseRollback {
+			order = append(order, component)
+		}
+	})
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return b.err
+	})
+	require.Error(t, err)
+	assert.Equal(t, []uow.Transactional{b, a}, order)
+}
+
+func TestUOWRollback_AggregatesRollbackErrorsIntoMultiError(t *testing.T) {
+	fnErr := fmt.Errorf("boom")
+	rollbackErr := fmt.Errorf("connection reset")
+	a := &foo{value: "a", tx: tx{value: "tx a", rollbackErr: rollbackErr}}
+	b := &foo{value: "b", tx: tx{value: "tx b"}, err: fnErr}
+
+	unit, err := uow.NewUnitOfWork(a, b)
+	require.NoError(t, err)
+
+	err = unit.Run(func(uow.ContextFunc) error {
+		return b.err
+	})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, fnErr))
+	assert.True(t, errors.Is(err, rollbackErr))
+
+	var multi *uow.MultiError
+	require.ErrorAs(t, err, &multi)
+	assert.Len(t, multi.Errors, 2)
+}
+
+func TestUOWWithRollbackErrorHandler(t *testing.T) {
+	rollbackErr := fmt.Errorf("connection reset")
+	a := &foo{value: "a", tx: tx{value: "tx a", rollbackErr: rollbackErr}}
+	b := &foo{value: "b", tx: tx{value: "tx b"}, err: fmt.Errorf("boom")}
+
+	unit, err := uow.NewUnitOfWork(a, b)
+	require.NoError(t, err)
+
+	var handled []error
+	err = unit.Run(func(uow.ContextFunc) error {
+		return b.err
+	}, uow.WithRollbackErrorHandler(func(_ uow.Transactional, err error) {
+		handled = append(handled, err)
+	}))
+	require.Error(t, err)
+	require.Len(t, handled, 1)
+	assert.Equal(t, rollbackErr, handled[0])
+}
+
+func TestUOWRun_CommitFailureDoesNotRollBackAlreadyCommittedParticipants(t *testing.T) {
+	a := &foo{value: "a", tx: tx{value: "tx a"}}
+	b := &foo{value: "b", tx: tx{value: "tx b", commitErr: fmt.Errorf("b commit err")}}
+
+	unit, err := uow.NewUnitOfWork(a, b)
+	require.NoError(t, err)
+
+	err = unit.Run(func(uow.ContextFunc) error { return nil })
+	require.Error(t, err)
+
+	assert.True(t, a.tx.committed)
+	assert.False(t, a.tx.rolledBack)
+	assert.True(t, b.tx.committed)
+	assert.True(t, b.tx.rolledBack)
+}